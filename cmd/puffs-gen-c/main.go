@@ -8,12 +8,19 @@
 // The command line arguments list the source Puffs files. If no arguments are
 // given, it reads from stdin.
 //
-// The generated program is written to stdout.
+// By default, the generated program is written to stdout as a single stream:
+// the .h contents, a "// C HEADER ENDS HERE." sentinel line, and then the .c
+// contents. Pass -split to instead write the .h and .c contents to separate,
+// independently clang-format-able files, named by -header-out and -impl-out
+// (defaulting to "puffs_<pkg>.h" and "puffs_<pkg>.c").
 package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"math/big"
 	"os"
 	"os/exec"
@@ -30,6 +37,16 @@ var (
 	one  = big.NewInt(1)
 )
 
+var (
+	splitFlag            = flag.Bool("split", false, "whether to emit separate .h and .c files instead of one combined stream")
+	headerOutFlag        = flag.String("header-out", "", "the header output filename, used with -split")
+	implOutFlag          = flag.String("impl-out", "", "the impl output filename, used with -split")
+	instrumentFlag       = flag.Bool("instrument", false, "whether to emit on_enter/on_exit/on_suspend metrics hooks around suspendible calls")
+	langFlag             = flag.String("lang", "c", `the target backend language; only "c" works today, "go" is recognized but refused`)
+	noLineDirectivesFlag = flag.Bool("no-line-directives", false,
+		"whether to suppress #line directives (and the companion .map.json) in generated C code")
+)
+
 // Prefixes are prepended to names to form a namespace and to avoid e.g.
 // "double" being a valid Puffs variable name but not a valid C one.
 const (
@@ -40,18 +57,68 @@ const (
 )
 
 func main() {
+	flag.Parse()
+	var backend Backend
+	switch *langFlag {
+	case "c":
+		backend = cBackend{}
+	case "go":
+		// goBackend only lowers scalar expressions; the surrounding
+		// function/struct skeleton and the coroutine save/restore/switch
+		// machinery are still hardcoded C (see goBackend's doc comment), so
+		// this would silently emit broken Go rather than a working
+		// decoder. Refuse it instead of shipping that.
+		fmt.Fprintf(os.Stderr, "puffs-gen-c: -lang=go is not yet a working backend "+
+			"(only expression-level lowering is pluggable so far; see goBackend's doc comment)\n")
+		os.Exit(1)
+	default:
+		fmt.Fprintf(os.Stderr, "puffs-gen-c: unknown -lang %q\n", *langFlag)
+		os.Exit(1)
+	}
 	generate.Main(func(pkgName string, tm *t.Map, files []*a.File) ([]byte, error) {
 		g := &gen{
-			pkgName: pkgName,
-			tm:      tm,
-			files:   files,
+			pkgName:        pkgName,
+			tm:             tm,
+			files:          files,
+			split:          *splitFlag,
+			instrument:     *instrumentFlag,
+			lineDirectives: !*noLineDirectivesFlag,
+			backend:        backend,
 		}
 		if err := g.generate(); err != nil {
 			return nil, err
 		}
+
+		if *splitFlag {
+			headerOut := *headerOutFlag
+			if headerOut == "" {
+				headerOut = fmt.Sprintf("puffs_%s.h", pkgName)
+			}
+			implOut := *implOutFlag
+			if implOut == "" {
+				implOut = fmt.Sprintf("puffs_%s.c", pkgName)
+			}
+			if err := clangFormatToFile(&g.headerBuffer, headerOut); err != nil {
+				return nil, err
+			}
+			if err := clangFormatToFile(&g.implBuffer, implOut); err != nil {
+				return nil, err
+			}
+			if g.lineDirectives {
+				if err := g.writeSrcMapFile(implOut + ".map.json"); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		}
+
+		combined := &bytes.Buffer{}
+		combined.Write(g.headerBuffer.Bytes())
+		combined.WriteString("// C HEADER ENDS HERE.\n\n")
+		combined.Write(g.implBuffer.Bytes())
 		stdout := &bytes.Buffer{}
 		cmd := exec.Command("clang-format", "-style=Chromium")
-		cmd.Stdin = &g.buffer
+		cmd.Stdin = combined
 		cmd.Stdout = stdout
 		cmd.Stderr = os.Stderr
 		if err := cmd.Run(); err != nil {
@@ -61,6 +128,31 @@ func main() {
 	})
 }
 
+// clangFormatToFile runs src through clang-format and writes the result to
+// the file named filename.
+func clangFormatToFile(src *bytes.Buffer, filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cmd := exec.Command("clang-format", "-style=Chromium")
+	cmd.Stdin = src
+	cmd.Stdout = f
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// writeSrcMapFile writes g.srcMap as JSON to filename.
+func (g *gen) writeSrcMapFile(filename string) error {
+	b, err := json.MarshalIndent(g.srcMap, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0644)
+}
+
 const userDefinedStatusBase = 128
 
 var builtInStatuses = [...]string{
@@ -119,8 +211,15 @@ const (
 const maxTemp = 10000
 
 type status struct {
-	name    string
-	msg     string
+	name string
+	msg  string
+	// jsonName is the machine-readable, snake_case spelling of msg, used by
+	// puffs_<pkg>_status_json. Unlike name, it has no "puffs_<pkg>_" or
+	// "error_"/"status_" prefix, e.g. "bad_argument" not
+	// "puffs_gif_error_bad_argument".
+	jsonName string
+	// kind is the JSON "kind" field: "ok", "status" or "error".
+	kind    string
 	isError bool
 }
 
@@ -131,23 +230,169 @@ type perFunc struct {
 	tempR       uint32
 	public      bool
 	suspendible bool
+	// instrumented is whether -instrument on_enter/on_exit/on_suspend hooks
+	// and the i_bytes_in/i_bytes_out counters are emitted for this func.
+	instrumented bool
+
+	// coroEnabled is whether this func gets a coroutine state machine: a
+	// "self->private_impl.c_<funcname>" struct holding a resume point
+	// (coro_state) and every local var, so that a suspendible call that
+	// short reads or short writes can later resume where it left off.
+	coroEnabled bool
+	coroNext    uint32
+	coroVars    []*a.Var
+
+	// liveVars is the set of coroVars (by name token) that writeCoroSuspend
+	// should actually spill at the suspend point currently being generated.
+	// It is refreshed before each top-level statement to the vars read
+	// anywhere from that statement to the end of the func body: a
+	// conservative (but much tighter than "every coroVar, always") "used
+	// later" approximation to true liveness. writeCoroRestore still
+	// restores every coroVar, since a single unconditional restore at
+	// function entry has to be ready for whichever coro_state case it jumps
+	// into.
+	liveVars map[t.ID]bool
+}
+
+// coroFieldName returns the private_impl field name under which n's
+// coroutine state (coro_state plus spilled locals) is stored.
+func coroFieldName(n *a.Func, tm *t.Map) string {
+	return "c_" + n.Name().String(tm)
+}
+
+// nextCoroState allocates the next resume point for the function currently
+// being generated. State 0 is reserved for "the call has not yet
+// suspended"; writeFuncImpl's switch starts there.
+func (g *gen) nextCoroState() uint32 {
+	cs := g.perFunc.coroNext
+	g.perFunc.coroNext++
+	// Record a new .map.json row for this suspend point, so a debugger
+	// extension can show the logical coroutine location. A single
+	// suspendible call (e.g. "in.dst.write?()") can allocate more than one
+	// coro state for a single #line entry, so this must append a row per
+	// call to nextCoroState rather than tag the enclosing statement's row
+	// once: tagging it once would silently drop every suspend point after
+	// the first for that statement.
+	if n := len(g.srcMap); n > 0 {
+		row := g.srcMap[n-1]
+		row.CoroState = cs
+		g.srcMap = append(g.srcMap, row)
+	}
+	return cs
+}
+
+// writeCoroRestore emits "v_foo = self->private_impl.c_funcname.f_foo;" for
+// every local var, so that locals saved before a previous suspend are
+// available again on resume. It is a no-op if the current func has no
+// coroutine state machine.
+func (g *gen) writeCoroRestore() {
+	if !g.perFunc.coroEnabled {
+		return
+	}
+	field := coroFieldName(g.perFunc.funk, g.tm)
+	for _, v := range g.perFunc.coroVars {
+		name := v.Name().String(g.tm)
+		g.printf("%s%s = self->private_impl.%s.%s%s;\n", vPrefix, name, field, fPrefix, name)
+	}
+}
+
+// writeCoroSuspend emits the save-and-jump code for a suspend point: it
+// spills g.perFunc.liveVars (the coroVars actually read again after this
+// point, not every local) and records stateID as the resume point. Callers
+// still emit their own "goto cleanup0;" / "return status;" around this, and
+// the "case stateID:" label right after the call site's suspend check, so
+// that resuming re-enters there.
+func (g *gen) writeCoroSuspend(stateID uint32) {
+	if !g.perFunc.coroEnabled {
+		return
+	}
+	field := coroFieldName(g.perFunc.funk, g.tm)
+	for _, v := range g.perFunc.coroVars {
+		if !g.perFunc.liveVars[v.Name()] {
+			continue
+		}
+		name := v.Name().String(g.tm)
+		g.printf("self->private_impl.%s.%s%s = %s%s;\n", field, fPrefix, name, vPrefix, name)
+	}
+	g.printf("self->private_impl.%s.coro_state = %d;\n", field, stateID)
+}
+
+// writeOnSuspend emits a call to the puffs_<pkg>_on_suspend hook, if
+// -instrument was given. It must be called with "status" already assigned
+// the suspending status code, and before the goto/return that acts on it.
+func (g *gen) writeOnSuspend() {
+	if !g.perFunc.instrumented {
+		return
+	}
+	g.printf("puffs_%s_on_suspend(\"%s\", status, self);", g.pkgName, g.perFunc.funk.Name().String(g.tm))
 }
 
 type gen struct {
-	buffer     bytes.Buffer
-	pkgName    string
-	tm         *t.Map
-	files      []*a.File
-	statusList []status
-	statusMap  map[t.ID]status
-	structList []*a.Struct
-	structMap  map[t.ID]*a.Struct
-	perFunc    perFunc
+	// headerBuffer and implBuffer accumulate the generated .h and .c output
+	// respectively. out points at whichever of the two is currently being
+	// written to; generate points out at each buffer in turn before calling
+	// genHeader and genImpl respectively.
+	headerBuffer bytes.Buffer
+	implBuffer   bytes.Buffer
+	out          *bytes.Buffer
+	split          bool
+	instrument     bool
+	lineDirectives bool
+	backend        Backend
+	pkgName        string
+	tm             *t.Map
+	files          []*a.File
+	statusList     []status
+	statusMap      map[t.ID]status
+	structList     []*a.Struct
+	structMap      map[t.ID]*a.Struct
+	perFunc        perFunc
+
+	// srcMap accumulates (puffs_file, puffs_line, puffs_col, coro_state)
+	// entries, one per #line directive emitted into implBuffer plus one per
+	// coro state allocated by nextCoroState, for the companion .map.json. It does not record the corresponding C line
+	// number: clang-format reflows the output afterwards, so the #line
+	// directives embedded in the .c file itself are the only mapping that
+	// stays accurate post-format.
+	srcMap []srcMapEntry
 }
 
-func (g *gen) printf(format string, args ...interface{}) { fmt.Fprintf(&g.buffer, format, args...) }
-func (g *gen) writeb(b byte)                             { g.buffer.WriteByte(b) }
-func (g *gen) writes(s string)                           { g.buffer.WriteString(s) }
+// srcMapEntry is one row of the companion .map.json emitted alongside split
+// output, letting a debugger extension show the logical Puffs source
+// location (and, for a suspendible call, its coroutine state ID) underlying
+// the #line directive the debugger just stepped to.
+type srcMapEntry struct {
+	PuffsFile string `json:"puffs_file"`
+	PuffsLine int    `json:"puffs_line"`
+	PuffsCol  int    `json:"puffs_col,omitempty"`
+	CoroState uint32 `json:"coro_state,omitempty"`
+}
+
+func (g *gen) printf(format string, args ...interface{}) { fmt.Fprintf(g.out, format, args...) }
+func (g *gen) writeb(b byte)                             { g.out.WriteByte(b) }
+func (g *gen) writes(s string)                           { g.out.WriteString(s) }
+
+// writeLineDirective emits a "#line NNN \"foo.puffs\"" directive pointing at
+// n's position, and records the corresponding row in g.srcMap, so that a
+// debugger stepping through the generated .c file lands on the Puffs source
+// line that produced it. The row's CoroState is 0 (not a suspend point);
+// each coro state that a suspendible call inside n's statement allocates
+// gets its own copy of the row, appended by nextCoroState.
+func (g *gen) writeLineDirective(n *a.Node) {
+	if !g.lineDirectives {
+		return
+	}
+	filename, line, col := n.Filename(), n.Line(), n.Column()
+	if filename == "" || line == 0 {
+		return
+	}
+	g.printf("#line %d %q\n", line, filename)
+	g.srcMap = append(g.srcMap, srcMapEntry{
+		PuffsFile: filename,
+		PuffsLine: int(line),
+		PuffsCol:  int(col),
+	})
+}
 
 func (g *gen) jumpTarget(n *a.While) (uint32, error) {
 	if g.perFunc.jumpTargets == nil {
@@ -189,10 +434,11 @@ func (g *gen) generate() error {
 		g.structMap[n.Name()] = n
 	}
 
+	g.out = &g.headerBuffer
 	if err := g.genHeader(); err != nil {
 		return err
 	}
-	g.writes("// C HEADER ENDS HERE.\n\n")
+	g.out = &g.implBuffer
 	return g.genImpl()
 }
 
@@ -226,6 +472,29 @@ func (g *gen) genHeader() error {
 	g.printf("} puffs_%s_status;\n\n", g.pkgName)
 	g.printf("bool puffs_%s_status_is_error(puffs_%s_status s);\n\n", g.pkgName, g.pkgName)
 	g.printf("const char* puffs_%s_status_string(puffs_%s_status s);\n\n", g.pkgName, g.pkgName)
+	g.writes("// puffs_<pkg>_status_json writes a stable JSON object describing s, of the\n")
+	g.writes("// form {\"pkg\":\"gif\",\"code\":-5,\"kind\":\"error\",\"name\":\"bad_argument\",\n")
+	g.writes("// \"message\":\"gif: bad argument\"}, to buf (which must hold at least n\n")
+	g.writes("// bytes) and returns the number of bytes written, following snprintf's\n")
+	g.writes("// truncation semantics.\n")
+	g.printf("size_t puffs_%s_status_json(puffs_%s_status s, char* buf, size_t n);\n\n", g.pkgName, g.pkgName)
+
+	if g.instrument {
+		g.writes("// ---------------- Instrumentation Hooks\n\n")
+		g.writes("// These hooks are called around suspendible function calls. They have\n")
+		g.writes("// weak, no-op default implementations, so linking against this library\n")
+		g.writes("// costs nothing by default. Define your own (non-weak) puffs_<pkg>_on_etc\n")
+		g.writes("// functions, e.g. to feed counters or histograms, to observe them.\n")
+		g.printf("void puffs_%s_on_enter(const char* fn, void* ctx) __attribute__((weak));\n", g.pkgName)
+		g.printf("void puffs_%s_on_enter(const char* fn, void* ctx) {}\n\n", g.pkgName)
+		g.printf("void puffs_%s_on_exit(const char* fn, puffs_%s_status s, uint64_t bytes_in,"+
+			" uint64_t bytes_out, void* ctx) __attribute__((weak));\n", g.pkgName, g.pkgName)
+		g.printf("void puffs_%s_on_exit(const char* fn, puffs_%s_status s, uint64_t bytes_in,"+
+			" uint64_t bytes_out, void* ctx) {}\n\n", g.pkgName, g.pkgName)
+		g.printf("void puffs_%s_on_suspend(const char* fn, puffs_%s_status s, void* ctx) __attribute__((weak));\n",
+			g.pkgName, g.pkgName)
+		g.printf("void puffs_%s_on_suspend(const char* fn, puffs_%s_status s, void* ctx) {}\n\n", g.pkgName, g.pkgName)
+	}
 
 	g.writes("// ---------------- Structs\n\n")
 	for _, n := range g.structList {
@@ -254,6 +523,10 @@ func (g *gen) genHeader() error {
 }
 
 func (g *gen) genImpl() error {
+	if g.split {
+		g.printf("// Code generated by puffs-gen-c. DO NOT EDIT.\n\n")
+		g.printf("#include \"puffs_%s.h\"\n\n", g.pkgName)
+	}
 	g.writes(baseImpl)
 	g.writes("\n")
 
@@ -275,6 +548,50 @@ func (g *gen) genImpl() error {
 	}
 	g.writes("};\n\n")
 
+	g.printf("const char* puffs_%s_status_json_names[%d] = {\n", g.pkgName, len(builtInStatuses)+len(g.statusList))
+	for _, s := range builtInStatuses {
+		msg := s
+		if strings.HasPrefix(msg, "status ") {
+			msg = msg[len("status "):]
+		} else if strings.HasPrefix(msg, "error ") {
+			msg = msg[len("error "):]
+		}
+		g.printf("%q,", jsonName(msg))
+	}
+	for _, s := range g.statusList {
+		g.printf("%q,", s.jsonName)
+	}
+	g.writes("};\n\n")
+
+	g.printf("const char* puffs_%s_status_json_messages[%d] = {\n", g.pkgName, len(builtInStatuses)+len(g.statusList))
+	for _, s := range builtInStatuses {
+		if strings.HasPrefix(s, "status ") {
+			s = s[len("status "):]
+		} else if strings.HasPrefix(s, "error ") {
+			s = s[len("error "):]
+		}
+		g.printf("%q,", jsonEscape(g.pkgName+": "+s))
+	}
+	for _, s := range g.statusList {
+		g.printf("%q,", jsonEscape(g.pkgName+": "+s.msg))
+	}
+	g.writes("};\n\n")
+
+	g.printf("const char* puffs_%s_status_json_kinds[%d] = {\n", g.pkgName, len(builtInStatuses)+len(g.statusList))
+	for _, s := range builtInStatuses {
+		kind := "status"
+		if strings.HasPrefix(s, "error ") {
+			kind = "error"
+		} else if s == "status ok" {
+			kind = "ok"
+		}
+		g.printf("%q,", kind)
+	}
+	for _, s := range g.statusList {
+		g.printf("%q,", s.kind)
+	}
+	g.writes("};\n\n")
+
 	g.printf("const char* puffs_%s_status_string(puffs_%s_status s) {\n", g.pkgName, g.pkgName)
 	g.writes("s = -(s >> 1); if (0 <= s) {\n")
 	g.printf("if (s < %d) { return puffs_%s_status_strings[s]; }\n",
@@ -285,6 +602,21 @@ func (g *gen) genImpl() error {
 	g.printf("}\nreturn \"%s: unknown status\";\n", g.pkgName)
 	g.writes("}\n\n")
 
+	g.printf("size_t puffs_%s_status_json(puffs_%s_status s, char* buf, size_t n) {\n", g.pkgName, g.pkgName)
+	g.writes("int32_t i = -(s >> 1);\n")
+	g.writes("if (0 <= i) {\n")
+	g.printf("if (i >= %d) { i -= %d; }\n", len(builtInStatuses), userDefinedStatusBase-len(builtInStatuses))
+	g.printf("if ((0 <= i) && (i < %d)) {\n", len(builtInStatuses)+len(g.statusList))
+	g.printf("return (size_t)snprintf(buf, n, \"{\\\"pkg\\\":\\\"%s\\\",\\\"code\\\":%%d,"+
+		"\\\"kind\\\":\\\"%%s\\\",\\\"name\\\":\\\"%%s\\\",\\\"message\\\":\\\"%%s\\\"}\", "+
+		"(int)s, puffs_%s_status_json_kinds[i], puffs_%s_status_json_names[i], puffs_%s_status_json_messages[i]);\n",
+		g.pkgName, g.pkgName, g.pkgName, g.pkgName)
+	g.writes("}\n}\n")
+	g.printf("return (size_t)snprintf(buf, n, \"{\\\"pkg\\\":\\\"%s\\\",\\\"code\\\":%%d,"+
+		"\\\"kind\\\":\\\"unknown\\\",\\\"name\\\":\\\"unknown\\\",\\\"message\\\":\\\"%s: unknown status\\\"}\", (int)s);\n",
+		g.pkgName, g.pkgName)
+	g.writes("}\n\n")
+
 	g.writes("// ---------------- Private Constructor and Destructor Prototypes\n\n")
 	for _, n := range g.structList {
 		if !n.Public() {
@@ -375,6 +707,45 @@ func (g *gen) cName(name string) string {
 	return string(b)
 }
 
+// jsonName converts a status message like "bad argument" to the
+// snake_case name used in puffs_<pkg>_status_json output, e.g.
+// "bad_argument". Unlike cName, it carries no "puffs_<pkg>_" prefix.
+func jsonName(msg string) string {
+	b := []byte(nil)
+	for _, r := range msg {
+		if 'A' <= r && r <= 'Z' {
+			b = append(b, byte(r+'a'-'A'))
+		} else if ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') || ('_' == r) {
+			b = append(b, byte(r))
+		} else if ' ' == r {
+			b = append(b, '_')
+		}
+	}
+	return string(b)
+}
+
+// jsonEscape escapes msg so that it can be embedded as the contents of a C
+// string literal which itself holds a JSON string value: '"' and '\' are
+// backslash-escaped, and other ASCII control characters (msg is e.g. a
+// status message from .puffs source, not untrusted input, but there's no
+// guarantee it avoids them) are emitted as "\u00XX", matching what
+// encoding/json would write. Non-ASCII bytes are passed through unescaped,
+// same as status_strings already does.
+func jsonEscape(msg string) string {
+	b := []byte(nil)
+	for _, r := range msg {
+		switch {
+		case r == '"' || r == '\\':
+			b = append(b, '\\', byte(r))
+		case r < 0x20:
+			b = append(b, []byte(fmt.Sprintf("\\u%04x", r))...)
+		default:
+			b = append(b, string(r)...)
+		}
+	}
+	return string(b)
+}
+
 func (g *gen) gatherStatuses(n *a.Status) error {
 	msg := n.Message().String(g.tm)
 	if len(msg) < 2 || msg[0] != '"' || msg[len(msg)-1] != '"' {
@@ -382,14 +753,18 @@ func (g *gen) gatherStatuses(n *a.Status) error {
 	}
 	msg = msg[1 : len(msg)-1]
 	prefix := "status "
+	kind := "status"
 	isError := n.Keyword().Key() == t.KeyError
 	if isError {
 		prefix = "error "
+		kind = "error"
 	}
 	s := status{
-		name:    g.cName(prefix + msg),
-		msg:     msg,
-		isError: isError,
+		name:     g.cName(prefix + msg),
+		msg:      msg,
+		jsonName: jsonName(msg),
+		kind:     kind,
+		isError:  isError,
 	}
 	g.statusList = append(g.statusList, s)
 	g.statusMap[n.Message()] = s
@@ -423,10 +798,47 @@ func (g *gen) writeStruct(n *a.Struct) error {
 		}
 		g.writes(";\n")
 	}
+	if err := g.writeCoroStructFields(n); err != nil {
+		return err
+	}
 	g.printf("} private_impl;\n } puffs_%s_%s;\n\n", g.pkgName, structName)
 	return nil
 }
 
+// writeCoroStructFields emits, for every public suspendible method of n, a
+// "c_<methodname>" field holding that method's coroutine resume point
+// (coro_state) and every one of its spilled locals. See writeCoroSuspend.
+func (g *gen) writeCoroStructFields(n *a.Struct) error {
+	for _, file := range g.files {
+		for _, d := range file.TopLevelDecls() {
+			if d.Kind() != a.KFunc {
+				continue
+			}
+			f := d.Func()
+			if !f.Public() || !f.Suspendible() || f.Receiver() != n.Name() {
+				continue
+			}
+			vars, err := g.collectVars(f.Body(), 0)
+			if err != nil {
+				return err
+			}
+			g.printf("// Coroutine state for %s, so that a suspended call can resume\n",
+				f.Name().String(g.tm))
+			g.writes("// where it left off.\n")
+			g.writes("struct {\n")
+			g.writes("uint32_t coro_state;\n")
+			for _, v := range vars {
+				if err := g.writeCTypeName(v.XType(), fPrefix, v.Name().String(g.tm)); err != nil {
+					return err
+				}
+				g.writes(";\n")
+			}
+			g.printf("} %s;\n", coroFieldName(f, g.tm))
+		}
+	}
+	return nil
+}
+
 func (g *gen) writeCtorSignature(n *a.Struct, public bool, ctor bool) {
 	structName := n.Name().String(g.tm)
 	ctorName := "destructor"
@@ -560,6 +972,7 @@ func (g *gen) writeFuncImpl(n *a.Func) error {
 		return err
 	}
 	g.writes("{\n")
+	g.writeLineDirective(n.Node())
 
 	// Check the previous status and the "self" arg.
 	if n.Public() {
@@ -605,23 +1018,70 @@ func (g *gen) writeFuncImpl(n *a.Func) error {
 	}
 	g.writes("\n")
 
+	// Emit the -instrument entry hook. Only public, suspendible funcs are
+	// instrumented: they are the ones with a cleanup0 exit path, and they are
+	// the API boundary that a host program actually calls.
+	if g.instrument && n.Suspendible() && n.Public() {
+		g.perFunc.instrumented = true
+		g.writes("uint64_t i_bytes_in = 0;\n")
+		g.writes("uint64_t i_bytes_out = 0;\n")
+		g.printf("puffs_%s_on_enter(\"%s\", self);\n", g.pkgName, n.Name().String(g.tm))
+	}
+
 	// Generate the local variables.
 	if err := g.writeVars(n.Body(), 0); err != nil {
 		return err
 	}
 	g.writes("\n")
 
-	// Generate the function body.
-	for _, o := range n.Body() {
+	// Public, suspendible funcs with a receiver get a coroutine state
+	// machine: a switch keyed off a saved resume point lets a suspendible
+	// call that short reads or short writes return to the caller and, on
+	// the next call, pick up again right where it left off, instead of
+	// starting the func over from the top.
+	if n.Public() && n.Suspendible() && n.Receiver() != 0 {
+		vars, err := g.collectVars(n.Body(), 0)
+		if err != nil {
+			return err
+		}
+		g.perFunc.coroEnabled = true
+		g.perFunc.coroNext = 1
+		g.perFunc.coroVars = vars
+		g.writeCoroRestore()
+		g.printf("switch (self->private_impl.%s.coro_state) {\ncase 0:;\n", coroFieldName(n, g.tm))
+	}
+
+	// Generate the function body. If this func has a coroutine state
+	// machine, refresh g.perFunc.liveVars before each top-level statement,
+	// so that a suspend point inside it only spills the coroVars actually
+	// read from here to the end of the func, not every coroVar.
+	body := n.Body()
+	for i, o := range body {
+		if g.perFunc.coroEnabled {
+			live, err := g.liveVarsAfter(body[i:])
+			if err != nil {
+				return err
+			}
+			g.perFunc.liveVars = live
+		}
 		if err := g.writeStatement(o, 0); err != nil {
 			return err
 		}
 	}
 	g.writes("\n")
 
+	if g.perFunc.coroEnabled {
+		g.writes("}\n")
+	}
+
 	if g.perFunc.suspendible {
 		if g.perFunc.public {
-			g.printf("cleanup0: self->private_impl.status = status;\n")
+			g.writes("cleanup0:\n")
+			if g.perFunc.instrumented {
+				g.printf("puffs_%s_on_exit(\"%s\", status, i_bytes_in, i_bytes_out, self);\n",
+					g.pkgName, n.Name().String(g.tm))
+			}
+			g.writes("self->private_impl.status = status;\n")
 		}
 		g.printf("return status;\n")
 	}
@@ -736,12 +1196,173 @@ func (g *gen) writeVars(block []*a.Node, depth uint32) error {
 	return nil
 }
 
+// collectVars returns, in declaration order, every local variable declared
+// anywhere in block (recursing into "if" and "while" bodies, mirroring
+// writeVars). It is used to spill and restore locals across a coroutine
+// suspend point; see writeCoroRestore and writeCoroSuspend.
+func (g *gen) collectVars(block []*a.Node, depth uint32) ([]*a.Var, error) {
+	if depth > a.MaxBodyDepth {
+		return nil, fmt.Errorf("body recursion depth too large")
+	}
+	depth++
+
+	vars := []*a.Var(nil)
+	for _, o := range block {
+		switch o.Kind() {
+		case a.KIf:
+			for o := o.If(); o != nil; o = o.ElseIf() {
+				vt, err := g.collectVars(o.BodyIfTrue(), depth)
+				if err != nil {
+					return nil, err
+				}
+				vars = append(vars, vt...)
+				vf, err := g.collectVars(o.BodyIfFalse(), depth)
+				if err != nil {
+					return nil, err
+				}
+				vars = append(vars, vf...)
+			}
+
+		case a.KVar:
+			vars = append(vars, o.Var())
+
+		case a.KWhile:
+			vw, err := g.collectVars(o.While().Body(), depth)
+			if err != nil {
+				return nil, err
+			}
+			vars = append(vars, vw...)
+		}
+	}
+	return vars, nil
+}
+
+// collectExprVars adds to used every local variable n reads or writes,
+// mirroring the same per-Kind traversal that writeExpr/writeExprOther use to
+// emit n. It is used (via collectStmtVars) to compute a per-suspend-point
+// live-var set for writeCoroSuspend, instead of always spilling every local.
+func (g *gen) collectExprVars(n *a.Expr, used map[t.ID]bool) {
+	if n == nil {
+		return
+	}
+	if n.ID0() == 0 {
+		if id1 := n.ID1(); id1.Key() != t.KeyThis {
+			used[id1] = true
+		}
+		return
+	}
+	if cv := n.ConstValue(); cv != nil {
+		return
+	}
+	switch n.ID0().Key() {
+	case t.KeyOpenParen:
+		g.collectExprVars(n.LHS().Expr(), used)
+		for _, o := range n.Args() {
+			g.collectExprVars(o.Arg().Value(), used)
+		}
+		return
+	case t.KeyOpenBracket:
+		g.collectExprVars(n.LHS().Expr(), used)
+		g.collectExprVars(n.RHS().Expr(), used)
+		return
+	case t.KeyColon:
+		g.collectExprVars(n.LHS().Expr(), used)
+		if mhs := n.MHS(); mhs != nil {
+			g.collectExprVars(mhs.Expr(), used)
+		}
+		if rhs := n.RHS(); rhs != nil {
+			g.collectExprVars(rhs.Expr(), used)
+		}
+		return
+	case t.KeyDot:
+		g.collectExprVars(n.LHS().Expr(), used)
+		return
+	}
+	switch n.ID0().Flags() & (t.FlagsUnaryOp | t.FlagsBinaryOp | t.FlagsAssociativeOp) {
+	case t.FlagsUnaryOp:
+		g.collectExprVars(n.RHS().Expr(), used)
+	case t.FlagsBinaryOp:
+		g.collectExprVars(n.LHS().Expr(), used)
+		if n.ID0().Key() != t.KeyXBinaryAs {
+			g.collectExprVars(n.RHS().Expr(), used)
+		}
+	case t.FlagsAssociativeOp:
+		for _, o := range n.Args() {
+			g.collectExprVars(o.Expr(), used)
+		}
+	}
+}
+
+// collectStmtVars adds to used every local variable referenced anywhere in
+// block (recursing into "if" and "while" bodies), mirroring writeStatement's
+// own traversal of a.Node kinds. KAssert, KJump and KReturn carry no
+// var-bearing sub-expressions in this generator's model: asserts are
+// compile-time only, and jump/return carry no values.
+func (g *gen) collectStmtVars(block []*a.Node, used map[t.ID]bool, depth uint32) error {
+	if depth > a.MaxBodyDepth {
+		return fmt.Errorf("body recursion depth too large")
+	}
+	depth++
+
+	for _, o := range block {
+		switch o.Kind() {
+		case a.KAssign:
+			n := o.Assign()
+			g.collectExprVars(n.LHS(), used)
+			g.collectExprVars(n.RHS(), used)
+
+		case a.KExpr:
+			g.collectExprVars(o.Expr(), used)
+
+		case a.KIf:
+			for n := o.If(); n != nil; n = n.ElseIf() {
+				g.collectExprVars(n.Condition(), used)
+				if err := g.collectStmtVars(n.BodyIfTrue(), used, depth); err != nil {
+					return err
+				}
+				if err := g.collectStmtVars(n.BodyIfFalse(), used, depth); err != nil {
+					return err
+				}
+			}
+
+		case a.KVar:
+			if v := o.Var().Value(); v != nil {
+				g.collectExprVars(v, used)
+			}
+
+		case a.KWhile:
+			n := o.While()
+			g.collectExprVars(n.Condition(), used)
+			if err := g.collectStmtVars(n.Body(), used, depth); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// liveVarsAfter returns the set of coroVars (by name token) read anywhere
+// from stmts to the end of the enclosing func body. It's a conservative
+// over-approximation of true liveness (it doesn't account for a var being
+// overwritten before its next read, and it's computed once per top-level
+// statement rather than per nested statement), but it is always a subset of
+// "every coroVar", which is what writeCoroSuspend spilled before this.
+func (g *gen) liveVarsAfter(stmts []*a.Node) (map[t.ID]bool, error) {
+	used := map[t.ID]bool{}
+	if err := g.collectStmtVars(stmts, used, 0); err != nil {
+		return nil, err
+	}
+	return used, nil
+}
+
 func (g *gen) writeStatement(n *a.Node, depth uint32) error {
 	if depth > a.MaxBodyDepth {
 		return fmt.Errorf("body recursion depth too large")
 	}
 	depth++
 
+	g.writeLineDirective(n)
+
 	switch n.Kind() {
 	case a.KAssert:
 		// Assertions only apply at compile-time.
@@ -758,10 +1379,17 @@ func (g *gen) writeStatement(n *a.Node, depth uint32) error {
 		if err := g.writeExpr(n.LHS(), replaceCallSuspendibles, parenthesesMandatory, depth); err != nil {
 			return err
 		}
-		// TODO: does KeyAmpHatEq need special consideration?
-		g.writes(cOpNames[0xFF&n.Operator().Key()])
-		if err := g.writeExpr(n.RHS(), replaceCallSuspendibles, parenthesesMandatory, depth); err != nil {
-			return err
+		if n.Operator().Key() == t.KeyAmpHatEq && !g.backend.HasNativeAmpHat() {
+			g.writes(" &= ~(")
+			if err := g.writeExpr(n.RHS(), replaceCallSuspendibles, parenthesesMandatory, depth); err != nil {
+				return err
+			}
+			g.writes(")")
+		} else {
+			g.writes(g.backend.BinaryOpString(n.Operator().Key()))
+			if err := g.writeExpr(n.RHS(), replaceCallSuspendibles, parenthesesMandatory, depth); err != nil {
+				return err
+			}
 		}
 		g.writes(";\n")
 		return nil
@@ -927,6 +1555,28 @@ func (g *gen) writeSuspendibles(n *a.Expr, depth uint32) error {
 	return g.writeCallSuspendibles(n, depth)
 }
 
+// writeCallSuspendibles walks n looking for suspendible calls and hands each
+// one to g.backend.WriteSuspendibleCall.
+//
+// This is a smaller step than "a real coroutine state machine for arbitrary
+// suspendible calls": what's here is resume-point bookkeeping that doesn't
+// care which call it's attached to (nextCoroState/writeCoroSuspend/
+// writeCoroRestore, plus the per-suspend-point live-var spill set computed
+// by liveVarsAfter). WriteSuspendibleCall itself is not general: it still
+// only recognizes the four built-in patterns (in.src.read_u8?(),
+// in.dst.write?(), in.dst.write_u8?(), this.decode_header?()), so an
+// arbitrary user-defined "foo?()", or a nested call like
+// "foo?().bar().qux?()(p?(), q?())", still falls through to the "cannot
+// convert" error below rather than being numbered and lowered. Shipping
+// that needs, and doesn't yet have: a call-site numbering pass over
+// evaluation order (this func's own walk order would drive it), a
+// writeCoroutineResume(stateID) that emits the "case stateID:" label paired
+// with each numbered call's save/restore, and integration with
+// g.perFunc.tempW/tempR so the temporaries writeExpr's replaceCallSuspendibles
+// introduces are spilled too instead of aliasing across a resume. Also
+// still open: this.decode_header?() is itself a nested suspendible call,
+// and resuming into it currently re-runs it from the start rather than from
+// wherever it suspended.
 func (g *gen) writeCallSuspendibles(n *a.Expr, depth uint32) error {
 	// The evaluation order for suspendible calls (which can have side effects)
 	// is important here: LHS, MHS, RHS, Args and finally the node itself.
@@ -953,85 +1603,394 @@ func (g *gen) writeCallSuspendibles(n *a.Expr, depth uint32) error {
 		return nil
 	}
 
-	// TODO: delete these hacks that only matches "in.src.read_u8?()" etc.
-	if isInSrcReadU8(g.tm, n) {
+	ok, err := g.backend.WriteSuspendibleCall(g, n, depth)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// TODO: fix this.
+		//
+		// This might involve calling g.writeExpr with replaceNothing??
+		return fmt.Errorf("cannot convert Puffs call %q for this backend", n.String(g.tm))
+	}
+	return nil
+}
+
+// Backend abstracts over the expression-level pieces of the target language
+// that gen emits (type names, operators and the built-in suspendible call
+// patterns). cBackend, emitting C, is the default. The rest of gen (struct,
+// function and coroutine scaffolding) emits C whichever Backend is used, so
+// goBackend does not produce working Go; see its doc comment.
+type Backend interface {
+	// TypeName returns the backend's spelling of the scalar type named by
+	// key (e.g. "uint8_t" for t.KeyU8 in C), or "" if key names a
+	// struct or other type that gen should fall back to its own naming
+	// convention for.
+	TypeName(key t.Key) string
+
+	// BinaryOpString returns the backend's spelling of the binary or
+	// assignment operator key, e.g. " + " or " += " in C.
+	BinaryOpString(key t.Key) string
+
+	// HasNativeAmpHat reports whether the backend's language has a native
+	// "and not" operator (Go's "&^"/"&^="). If false, writeExprBinaryOp and
+	// the KAssign statement writer fall back to emitting "a & ~(b)" /
+	// "a &= ~(b)" instead of asking BinaryOpString for KeyXBinaryAmpHat /
+	// KeyAmpHatEq.
+	HasNativeAmpHat() bool
+
+	// WriteSuspendibleCall lowers one of the built-in suspendible call
+	// patterns (in.src.read_u8?(), in.dst.write?(), in.dst.write_u8?(),
+	// this.decode_header?()) to backend code, via g. ok is false if n
+	// did not match any pattern this backend recognizes.
+	WriteSuspendibleCall(g *gen, n *a.Expr, depth uint32) (ok bool, err error)
+
+	// QualifiedTypeName returns the backend's naming convention for a
+	// struct (or other non-scalar) type named typeName in package pkgName,
+	// used when TypeName returns "" for a non-scalar type's key.
+	QualifiedTypeName(pkgName, typeName string) string
+}
+
+// cBackend is the default Backend, emitting C99.
+type cBackend struct{}
+
+func (cBackend) TypeName(key t.Key) string {
+	if key < t.Key(len(cTypeNames)) {
+		return cTypeNames[key]
+	}
+	return ""
+}
+
+func (cBackend) BinaryOpString(key t.Key) string {
+	return cOpNames[0xFF&key]
+}
+
+func (cBackend) HasNativeAmpHat() bool { return false }
+
+func (cBackend) QualifiedTypeName(pkgName, typeName string) string {
+	return fmt.Sprintf("puffs_%s_%s", pkgName, typeName)
+}
+
+// TODO: delete these hacks that only matches "in.src.read_u8?()" etc.
+func (cBackend) WriteSuspendibleCall(g *gen, n *a.Expr, depth uint32) (bool, error) {
+	switch {
+	case isInSrcReadU8(g.tm, n):
 		if g.perFunc.tempW > maxTemp {
-			return fmt.Errorf("too many temporary variables required")
+			return false, fmt.Errorf("too many temporary variables required")
 		}
 		temp := g.perFunc.tempW
 		g.perFunc.tempW++
+		coroState := g.nextCoroState()
 
-		// TODO: suspend coroutine state.
 		g.printf("if (%ssrc->ri >= %ssrc->wi) { status = "+
 			"%ssrc->closed ? puffs_%s_error_unexpected_eof : puffs_%s_status_short_read;",
 			aPrefix, aPrefix, aPrefix, g.pkgName, g.pkgName)
+		g.writeOnSuspend()
+		g.writeCoroSuspend(coroState)
 		if g.perFunc.public && g.perFunc.suspendible {
 			g.writes("goto cleanup0;")
 		} else {
 			g.writes("return status;")
 		}
 		g.writes("}\n")
+		if g.perFunc.coroEnabled {
+			g.printf("case %d:;\n", coroState)
+		}
 		// TODO: watch for passing an array type to writeCTypeName? In C, an
 		// array type can decay into a pointer.
 		if err := g.writeCTypeName(n.MType(), tPrefix, fmt.Sprint(temp)); err != nil {
-			return err
+			return false, err
 		}
 		g.printf(" = %ssrc->ptr[%ssrc->ri++];\n", aPrefix, aPrefix)
+		if g.perFunc.instrumented {
+			g.writes("i_bytes_in++;\n")
+		}
 
-	} else if isInDst(g.tm, n, t.KeyWrite) {
-		// TODO: suspend coroutine state.
-		//
+	case isInDst(g.tm, n, t.KeyWrite):
 		// TODO: don't assume that the argument is "this.stack[s:]".
+		closedState := g.nextCoroState()
 		g.printf("if (%sdst->closed) { status = puffs_%s_error_closed_for_writes;", aPrefix, g.pkgName)
+		g.writeOnSuspend()
+		g.writeCoroSuspend(closedState)
 		if g.perFunc.public && g.perFunc.suspendible {
 			g.writes("goto cleanup0;")
 		} else {
 			g.writes("return status;")
 		}
 		g.writes("}\n")
+		if g.perFunc.coroEnabled {
+			g.printf("case %d:;\n", closedState)
+		}
+		shortWriteState := g.nextCoroState()
 		g.printf("if ((%sdst->len - %sdst->wi) < (sizeof(self->private_impl.f_stack) - v_s)) {", aPrefix, aPrefix)
 		g.printf("status = puffs_%s_status_short_write;", g.pkgName)
+		g.writeOnSuspend()
+		g.writeCoroSuspend(shortWriteState)
 		if g.perFunc.public && g.perFunc.suspendible {
 			g.writes("goto cleanup0;")
 		} else {
 			g.writes("return status;")
 		}
 		g.writes("}\n")
+		if g.perFunc.coroEnabled {
+			g.printf("case %d:;\n", shortWriteState)
+		}
 		g.printf("memmove(" +
 			"a_dst->ptr + a_dst->wi," +
 			"self->private_impl.f_stack + v_s," +
 			"sizeof(self->private_impl.f_stack) - v_s);\n")
 		g.printf("a_dst->wi += sizeof(self->private_impl.f_stack) - v_s;\n")
+		if g.perFunc.instrumented {
+			g.writes("i_bytes_out += sizeof(self->private_impl.f_stack) - v_s;\n")
+		}
 
-	} else if isInDst(g.tm, n, t.KeyWriteU8) {
-		// TODO: suspend coroutine state.
+	case isInDst(g.tm, n, t.KeyWriteU8):
+		coroState := g.nextCoroState()
 		g.printf("if (%sdst->wi >= %sdst->len) { status = puffs_%s_status_short_write;",
 			aPrefix, aPrefix, g.pkgName)
+		g.writeOnSuspend()
+		g.writeCoroSuspend(coroState)
 		if g.perFunc.public && g.perFunc.suspendible {
 			g.writes("goto cleanup0;")
 		} else {
 			g.writes("return status;")
 		}
 		g.writes("}\n")
+		if g.perFunc.coroEnabled {
+			g.printf("case %d:;\n", coroState)
+		}
 		g.printf("%sdst->ptr[%sdst->wi++] = ", aPrefix, aPrefix)
 		x := n.Args()[0].Arg().Value()
 		if err := g.writeExpr(x, replaceCallSuspendibles, parenthesesMandatory, depth); err != nil {
-			return err
+			return false, err
+		}
+		if g.perFunc.instrumented {
+			g.writes(";\ni_bytes_out++")
 		}
 		g.writes(";\n")
 
-	} else if isThisDecodeHeader(g.tm, n) {
+	case isThisDecodeHeader(g.tm, n):
+		// TODO: decode_header is itself a private suspendible call and does
+		// not yet have its own coroutine state; resuming here currently
+		// re-runs it from the start rather than from wherever it suspended.
+		coroState := g.nextCoroState()
 		g.printf("status = puffs_%s_%s_decode_header(self, %ssrc);\n",
 			g.pkgName, g.perFunc.funk.Receiver().String(g.tm), aPrefix)
-		g.writes("if (status) { goto cleanup0; }\n")
+		g.writes("if (status) {")
+		g.writeCoroSuspend(coroState)
+		g.writes("goto cleanup0; }\n")
+		if g.perFunc.coroEnabled {
+			g.printf("case %d:;\n", coroState)
+		}
 
-	} else {
-		// TODO: fix this.
-		//
-		// This might involve calling g.writeExpr with replaceNothing??
-		return fmt.Errorf("cannot convert Puffs call %q to C", n.String(g.tm))
+	default:
+		return false, nil
 	}
-	return nil
+	return true, nil
+}
+
+// goBackend only lowers the scalar expression-level pieces of Backend
+// (TypeName, BinaryOpString, HasNativeAmpHat, QualifiedTypeName,
+// WriteSuspendibleCall's own if/else and field-access text). It is not a
+// working alternative to cBackend: genHeader's #ifndef/extern "C"/typedef
+// struct skeleton, writeCtorSignature/writeFuncSignature's C function
+// syntax, and critically writeCoroRestore/writeCoroSuspend (which emit a
+// hardcoded "self->private_impl...") and writeFuncImpl's
+// "switch (self->private_impl.%s.coro_state) {" all hardcode C regardless
+// of backend, and the coro_state switch relies on C's implicit case
+// fallthrough, which Go does not have. main() refuses -lang=go for exactly
+// this reason; do not wire it up again until those are also routed through
+// Backend.
+type goBackend struct{}
+
+func (goBackend) TypeName(key t.Key) string {
+	if key < t.Key(len(goTypeNames)) {
+		return goTypeNames[key]
+	}
+	return ""
+}
+
+func (goBackend) BinaryOpString(key t.Key) string {
+	return goOpNames[0xFF&key]
+}
+
+func (goBackend) HasNativeAmpHat() bool { return true }
+
+func (goBackend) QualifiedTypeName(pkgName, typeName string) string {
+	return fmt.Sprintf("%s_%s", pkgName, typeName)
+}
+
+func (goBackend) WriteSuspendibleCall(g *gen, n *a.Expr, depth uint32) (bool, error) {
+	switch {
+	case isInSrcReadU8(g.tm, n):
+		if g.perFunc.tempW > maxTemp {
+			return false, fmt.Errorf("too many temporary variables required")
+		}
+		temp := g.perFunc.tempW
+		g.perFunc.tempW++
+		coroState := g.nextCoroState()
+
+		g.printf("if %ssrc.ri >= %ssrc.wi {\n", aPrefix, aPrefix)
+		g.printf("if %ssrc.closed {\nstatus = %s_error_unexpected_eof\n} else {\nstatus = %s_status_short_read\n}\n",
+			aPrefix, g.pkgName, g.pkgName)
+		g.writeOnSuspend()
+		g.writeCoroSuspend(coroState)
+		if g.perFunc.public && g.perFunc.suspendible {
+			g.writes("goto cleanup0\n")
+		} else {
+			g.writes("return status\n")
+		}
+		g.writes("}\n")
+		if g.perFunc.coroEnabled {
+			g.printf("case %d:\n", coroState)
+		}
+		g.printf("%s%d := %ssrc.ptr[%ssrc.ri]\n%ssrc.ri++\n", tPrefix, temp, aPrefix, aPrefix, aPrefix)
+		if g.perFunc.instrumented {
+			g.writes("i_bytes_in++\n")
+		}
+
+	case isInDst(g.tm, n, t.KeyWrite):
+		// TODO: don't assume that the argument is "this.stack[s:]".
+		closedState := g.nextCoroState()
+		g.printf("if %sdst.closed {\nstatus = %s_error_closed_for_writes\n", aPrefix, g.pkgName)
+		g.writeOnSuspend()
+		g.writeCoroSuspend(closedState)
+		if g.perFunc.public && g.perFunc.suspendible {
+			g.writes("goto cleanup0\n")
+		} else {
+			g.writes("return status\n")
+		}
+		g.writes("}\n")
+		if g.perFunc.coroEnabled {
+			g.printf("case %d:\n", closedState)
+		}
+		shortWriteState := g.nextCoroState()
+		g.printf("if (%sdst.len - %sdst.wi) < (len(self.private_impl.f_stack) - v_s) {\n", aPrefix, aPrefix)
+		g.printf("status = %s_status_short_write\n", g.pkgName)
+		g.writeOnSuspend()
+		g.writeCoroSuspend(shortWriteState)
+		if g.perFunc.public && g.perFunc.suspendible {
+			g.writes("goto cleanup0\n")
+		} else {
+			g.writes("return status\n")
+		}
+		g.writes("}\n")
+		if g.perFunc.coroEnabled {
+			g.printf("case %d:\n", shortWriteState)
+		}
+		g.writes("copy(" +
+			"a_dst.ptr[a_dst.wi:]," +
+			"self.private_impl.f_stack[v_s:])\n")
+		g.writes("a_dst.wi += len(self.private_impl.f_stack) - v_s\n")
+		if g.perFunc.instrumented {
+			g.writes("i_bytes_out += len(self.private_impl.f_stack) - v_s\n")
+		}
+
+	case isInDst(g.tm, n, t.KeyWriteU8):
+		coroState := g.nextCoroState()
+		g.printf("if %sdst.wi >= %sdst.len {\nstatus = %s_status_short_write\n", aPrefix, aPrefix, g.pkgName)
+		g.writeOnSuspend()
+		g.writeCoroSuspend(coroState)
+		if g.perFunc.public && g.perFunc.suspendible {
+			g.writes("goto cleanup0\n")
+		} else {
+			g.writes("return status\n")
+		}
+		g.writes("}\n")
+		if g.perFunc.coroEnabled {
+			g.printf("case %d:\n", coroState)
+		}
+		g.printf("%sdst.ptr[%sdst.wi] = ", aPrefix, aPrefix)
+		x := n.Args()[0].Arg().Value()
+		if err := g.writeExpr(x, replaceCallSuspendibles, parenthesesMandatory, depth); err != nil {
+			return false, err
+		}
+		g.writes("\n")
+		g.printf("%sdst.wi++\n", aPrefix)
+		if g.perFunc.instrumented {
+			g.writes("i_bytes_out++\n")
+		}
+
+	case isThisDecodeHeader(g.tm, n):
+		// TODO: decode_header is itself a private suspendible call and does
+		// not yet have its own coroutine state; resuming here currently
+		// re-runs it from the start rather than from wherever it suspended
+		// (same known gap as cBackend).
+		coroState := g.nextCoroState()
+		g.printf("status = %s_%s_decode_header(self, %ssrc)\n",
+			g.pkgName, g.perFunc.funk.Receiver().String(g.tm), aPrefix)
+		g.writes("if status != nil {\n")
+		g.writeCoroSuspend(coroState)
+		g.writes("goto cleanup0\n}\n")
+		if g.perFunc.coroEnabled {
+			g.printf("case %d:\n", coroState)
+		}
+
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+var goTypeNames = [...]string{
+	t.KeyI8:    "int8",
+	t.KeyI16:   "int16",
+	t.KeyI32:   "int32",
+	t.KeyI64:   "int64",
+	t.KeyU8:    "uint8",
+	t.KeyU16:   "uint16",
+	t.KeyU32:   "uint32",
+	t.KeyU64:   "uint64",
+	t.KeyUsize: "uintptr",
+	t.KeyBool:  "bool",
+}
+
+var goOpNames = [256]string{
+	t.KeyEq:       " = ",
+	t.KeyPlusEq:   " += ",
+	t.KeyMinusEq:  " -= ",
+	t.KeyStarEq:   " *= ",
+	t.KeySlashEq:  " /= ",
+	t.KeyShiftLEq: " <<= ",
+	t.KeyShiftREq: " >>= ",
+	t.KeyAmpEq:    " &= ",
+	// Unlike C, Go has a native "and not" operator, so no workaround is
+	// needed here.
+	t.KeyAmpHatEq: " &^= ",
+	t.KeyPipeEq:   " |= ",
+	t.KeyHatEq:    " ^= ",
+
+	t.KeyXUnaryPlus:  "+",
+	t.KeyXUnaryMinus: "-",
+	t.KeyXUnaryNot:   "!",
+
+	t.KeyXBinaryPlus:        " + ",
+	t.KeyXBinaryMinus:       " - ",
+	t.KeyXBinaryStar:        " * ",
+	t.KeyXBinarySlash:       " / ",
+	t.KeyXBinaryShiftL:      " << ",
+	t.KeyXBinaryShiftR:      " >> ",
+	t.KeyXBinaryAmp:         " & ",
+	t.KeyXBinaryAmpHat:      " &^ ",
+	t.KeyXBinaryPipe:        " | ",
+	t.KeyXBinaryHat:         " ^ ",
+	t.KeyXBinaryNotEq:       " != ",
+	t.KeyXBinaryLessThan:    " < ",
+	t.KeyXBinaryLessEq:      " <= ",
+	t.KeyXBinaryEqEq:        " == ",
+	t.KeyXBinaryGreaterEq:   " >= ",
+	t.KeyXBinaryGreaterThan: " > ",
+	t.KeyXBinaryAnd:         " && ",
+	t.KeyXBinaryOr:          " || ",
+	t.KeyXBinaryAs:          " no_such_as_Go_operator ",
+
+	t.KeyXAssociativePlus: " + ",
+	t.KeyXAssociativeStar: " * ",
+	t.KeyXAssociativeAmp:  " & ",
+	t.KeyXAssociativePipe: " | ",
+	t.KeyXAssociativeHat:  " ^ ",
+	t.KeyXAssociativeAnd:  " && ",
+	t.KeyXAssociativeOr:   " || ",
 }
 
 func (g *gen) writeExpr(n *a.Expr, rp replacementPolicy, pp parenthesesPolicy, depth uint32) error {
@@ -1073,7 +2032,7 @@ func (g *gen) writeExpr(n *a.Expr, rp replacementPolicy, pp parenthesesPolicy, d
 			return err
 		}
 	case t.FlagsUnaryOp:
-		if err := g.writeExprUnaryOp(n, rp, depth); err != nil {
+		if err := g.writeExprUnaryOp(n, rp, pp, depth); err != nil {
 			return err
 		}
 	case t.FlagsBinaryOp:
@@ -1118,7 +2077,41 @@ func (g *gen) writeExprOther(n *a.Expr, rp replacementPolicy, depth uint32) erro
 			g.writes(")")
 			return nil
 		}
-		// TODO.
+		// n is "recv.method(args)", a non-suspendible method call. Lower it
+		// to puffs_<pkg>_<recv-type>_<method>(recv, args...), mirroring the
+		// "puffs_<pkg>_<recv>_decode_header(self, ...)" calls that
+		// cBackend.WriteSuspendibleCall already emits by hand.
+		recv := n.LHS().Expr()
+		if recv.ID0().Key() != t.KeyDot {
+			return fmt.Errorf("unrecognized receiver %q for writeExprOther call", recv.String(g.tm))
+		}
+		method := recv.ID1()
+		recv = recv.LHS().Expr()
+		recvType := recv.MType().Name()
+		if recvType == 0 {
+			return fmt.Errorf("cannot determine receiver type for call %q", n.String(g.tm))
+		}
+		g.printf("puffs_%s_%s_%s(", g.pkgName, recvType.String(g.tm), method.String(g.tm))
+		// Every generated function's receiver parameter is a
+		// "puffs_<pkg>_<Type> *self", so pass a pointer, not a value. "this"
+		// is special-cased to the "self" parameter itself, matching the
+		// hand-emitted decode_header call above; anything else needs "&".
+		if recv.ID0() == 0 && recv.ID1().Key() == t.KeyThis {
+			g.writes("self")
+		} else {
+			g.writes("&")
+			if err := g.writeExpr(recv, rp, parenthesesMandatory, depth); err != nil {
+				return err
+			}
+		}
+		for _, o := range n.Args() {
+			g.writes(",")
+			if err := g.writeExpr(o.Arg().Value(), rp, parenthesesOptional, depth); err != nil {
+				return err
+			}
+		}
+		g.writes(")")
+		return nil
 
 	case t.KeyOpenBracket:
 		// n is an index.
@@ -1133,8 +2126,39 @@ func (g *gen) writeExprOther(n *a.Expr, rp replacementPolicy, depth uint32) erro
 		return nil
 
 	case t.KeyColon:
-	// n is a slice.
-	// TODO.
+		// n is a slice, "x[i:j]". Lower it to a puffs_base_slice_u8 struct
+		// literal, the same runtime type that in.src/in.dst's ptr/len
+		// fields already use.
+		g.writes("((puffs_base_slice_u8){.ptr = ")
+		if err := g.writeExpr(n.LHS().Expr(), rp, parenthesesMandatory, depth); err != nil {
+			return err
+		}
+		if mhs := n.MHS(); mhs != nil {
+			g.writes(" + ")
+			if err := g.writeExpr(mhs.Expr(), rp, parenthesesMandatory, depth); err != nil {
+				return err
+			}
+		}
+		g.writes(", .len = ")
+		if rhs := n.RHS(); rhs != nil {
+			if err := g.writeExpr(rhs.Expr(), rp, parenthesesMandatory, depth); err != nil {
+				return err
+			}
+		} else {
+			g.writes("sizeof(")
+			if err := g.writeExpr(n.LHS().Expr(), rp, parenthesesMandatory, depth); err != nil {
+				return err
+			}
+			g.writes(")")
+		}
+		if n.MHS() != nil {
+			g.writes(" - ")
+			if err := g.writeExpr(n.MHS().Expr(), rp, parenthesesMandatory, depth); err != nil {
+				return err
+			}
+		}
+		g.writes("})")
+		return nil
 
 	case t.KeyDot:
 		if n.LHS().Expr().ID1().Key() == t.KeyIn {
@@ -1212,8 +2236,17 @@ func isLowBits(tm *t.Map, n *a.Expr) bool {
 	return n.ID0().Key() == t.KeyDot && n.ID1().Key() == t.KeyLowBits
 }
 
-func (g *gen) writeExprUnaryOp(n *a.Expr, rp replacementPolicy, depth uint32) error {
-	// TODO.
+func (g *gen) writeExprUnaryOp(n *a.Expr, rp replacementPolicy, pp parenthesesPolicy, depth uint32) error {
+	if pp == parenthesesMandatory {
+		g.writeb('(')
+	}
+	g.writes(g.backend.BinaryOpString(n.ID0().Key()))
+	if err := g.writeExpr(n.RHS().Expr(), rp, parenthesesMandatory, depth); err != nil {
+		return err
+	}
+	if pp == parenthesesMandatory {
+		g.writeb(')')
+	}
 	return nil
 }
 
@@ -1228,10 +2261,17 @@ func (g *gen) writeExprBinaryOp(n *a.Expr, rp replacementPolicy, pp parenthesesP
 	if err := g.writeExpr(n.LHS().Expr(), rp, parenthesesMandatory, depth); err != nil {
 		return err
 	}
-	// TODO: does KeyXBinaryAmpHat need special consideration?
-	g.writes(cOpNames[0xFF&op.Key()])
-	if err := g.writeExpr(n.RHS().Expr(), rp, parenthesesMandatory, depth); err != nil {
-		return err
+	if op.Key() == t.KeyXBinaryAmpHat && !g.backend.HasNativeAmpHat() {
+		g.writes(" & ~(")
+		if err := g.writeExpr(n.RHS().Expr(), rp, parenthesesMandatory, depth); err != nil {
+			return err
+		}
+		g.writes(")")
+	} else {
+		g.writes(g.backend.BinaryOpString(op.Key()))
+		if err := g.writeExpr(n.RHS().Expr(), rp, parenthesesMandatory, depth); err != nil {
+			return err
+		}
 	}
 	if pp == parenthesesMandatory {
 		g.writeb(')')
@@ -1255,7 +2295,7 @@ func (g *gen) writeExprAs(lhs *a.Expr, rhs *a.TypeExpr, rp replacementPolicy, de
 }
 
 func (g *gen) writeExprAssociativeOp(n *a.Expr, rp replacementPolicy, depth uint32) error {
-	opName := cOpNames[0xFF&n.ID0().Key()]
+	opName := g.backend.BinaryOpString(n.ID0().Key())
 	for i, o := range n.Args() {
 		if i != 0 {
 			g.writes(opName)
@@ -1291,15 +2331,10 @@ func (g *gen) writeCTypeName(n *a.TypeExpr, varNamePrefix string, varName string
 		return fmt.Errorf("cannot convert Puffs type %q to C", n.String(g.tm))
 	}
 
-	fallback := true
-	if k := innermost.Name().Key(); k < t.Key(len(cTypeNames)) {
-		if s := cTypeNames[k]; s != "" {
-			g.writes(s)
-			fallback = false
-		}
-	}
-	if fallback {
-		g.printf("puffs_%s_%s", g.pkgName, n.Name().String(g.tm))
+	if s := g.backend.TypeName(innermost.Name().Key()); s != "" {
+		g.writes(s)
+	} else {
+		g.writes(g.backend.QualifiedTypeName(g.pkgName, n.Name().String(g.tm)))
 	}
 
 	for i := 0; i < numPointers; i++ {
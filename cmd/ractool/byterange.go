@@ -0,0 +1,88 @@
+// Copyright 2019 The Wuffs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteRange is a half-open [Low, High) byte range, the unit that a future
+// -serve handler would translate into "the minimal set of chunk decodes"
+// (the same logic that backs -drange).
+type byteRange struct {
+	Low, High int64
+}
+
+// parseHTTPRange parses the value of a single-range HTTP "Range" header
+// (e.g. "bytes=400-499", "bytes=400-", "bytes=-500") against a resource of
+// the given total size, returning the byteRange it refers to.
+//
+// It only supports a single range, not a multi-range "bytes=0-0,-1" request:
+// -serve doesn't exist yet, but when it does, returning 200 with the whole
+// body (by treating a multi-range request as if Range were absent, per RFC
+// 7233 section 3.1) is an acceptable fallback, so parseHTTPRange rejects
+// those with an error rather than guessing.
+func parseHTTPRange(header string, size int64) (byteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return byteRange{}, fmt.Errorf("byterange: missing %q prefix", prefix)
+	}
+	spec := header[len(prefix):]
+	if strings.Contains(spec, ",") {
+		return byteRange{}, fmt.Errorf("byterange: multi-range requests are not supported")
+	}
+
+	i := strings.IndexByte(spec, '-')
+	if i < 0 {
+		return byteRange{}, fmt.Errorf("byterange: malformed range %q", header)
+	}
+	lowStr, highStr := spec[:i], spec[i+1:]
+
+	if lowStr == "" {
+		// "bytes=-500" means the last 500 bytes.
+		if highStr == "" {
+			return byteRange{}, fmt.Errorf("byterange: malformed range %q", header)
+		}
+		suffixLen, err := strconv.ParseInt(highStr, 10, 64)
+		if err != nil || suffixLen < 0 {
+			return byteRange{}, fmt.Errorf("byterange: malformed range %q", header)
+		}
+		if suffixLen > size {
+			suffixLen = size
+		}
+		return byteRange{Low: size - suffixLen, High: size}, nil
+	}
+
+	low, err := strconv.ParseInt(lowStr, 10, 64)
+	if err != nil || low < 0 {
+		return byteRange{}, fmt.Errorf("byterange: malformed range %q", header)
+	}
+	high := size - 1
+	if highStr != "" {
+		high, err = strconv.ParseInt(highStr, 10, 64)
+		if err != nil || high < low {
+			return byteRange{}, fmt.Errorf("byterange: malformed range %q", header)
+		}
+	}
+	if low >= size {
+		return byteRange{}, fmt.Errorf("byterange: range %q not satisfiable for size %d", header, size)
+	}
+	if high >= size {
+		high = size - 1
+	}
+	return byteRange{Low: low, High: high + 1}, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2019 The Wuffs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestParseHTTPRange(t *testing.T) {
+	const size = 1000
+	testCases := []struct {
+		header  string
+		want    byteRange
+		wantErr bool
+	}{
+		{"bytes=400-499", byteRange{400, 500}, false},
+		{"bytes=400-", byteRange{400, 1000}, false},
+		{"bytes=-500", byteRange{500, 1000}, false},
+		{"bytes=0-0", byteRange{0, 1}, false},
+		{"bytes=999-", byteRange{999, 1000}, false},
+		{"bytes=0-9999", byteRange{0, 1000}, false},
+		{"bytes=-99999", byteRange{0, 1000}, false},
+		{"bytes=1000-", byteRange{}, true},
+		{"bytes=500-400", byteRange{}, true},
+		{"bytes=abc-def", byteRange{}, true},
+		{"bytes=0-0,100-200", byteRange{}, true},
+		{"frobnicate=0-1", byteRange{}, true},
+		{"bytes=", byteRange{}, true},
+	}
+	for _, tc := range testCases {
+		got, err := parseHTTPRange(tc.header, size)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseHTTPRange(%q): err = %v, wantErr = %v", tc.header, err, tc.wantErr)
+			continue
+		}
+		if err == nil && got != tc.want {
+			t.Errorf("parseHTTPRange(%q): got %+v, want %+v", tc.header, got, tc.want)
+		}
+	}
+}
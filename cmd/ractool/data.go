@@ -16,6 +16,20 @@
 
 package main
 
+// BLOCKED: -codec=zstd/brotli, -workers and -serve/-addr below are
+// documented as the intended CLI surface, but ractool has no main.go and
+// there is no lib/rac package in this checkout for them to call into. Until
+// those land, passing any of those flags has nothing to dispatch to.
+//
+// -workers' ordering guarantee (compress concurrently, still write chunks
+// out in order) doesn't depend on lib/rac, so that piece is built and
+// tested standalone in parallelOrdered (workerpool.go); it just isn't wired
+// to a chunk-compression loop yet.
+//
+// Likewise, -serve's "Range header -> byte range" parsing doesn't depend on
+// lib/rac either, so it's built and tested standalone in parseHTTPRange
+// (byterange.go); turning that byteRange into "the minimal set of chunk
+// decodes" still needs the RAC index reader that lib/rac would provide.
 const usageStr = `Usage:
 
 ractool [flags] [input_filename]
@@ -23,7 +37,7 @@ ractool [flags] [input_filename]
 If no input_filename is given, stdin is used. Either way, output is written to
 stdout.
 
-The flags should include exactly one of -decode or -encode.
+The flags should include exactly one of -decode, -encode or -serve.
 
 When encoding, the input is partitioned into chunks and each chunk is
 compressed independently. You can specify the target chunk size in terms of
@@ -48,6 +62,7 @@ Examples:
   ractool -decode -drange=400:500 foo.rac
   ractool -encode foo.dat > foo.rac
   ractool -encode -codec=zlib -dchunksize=256 foo.dat > foo.raczlib
+  ractool -serve -addr=:8080 foo.rac
 
 General Flags:
 
@@ -55,22 +70,35 @@ General Flags:
     whether to decode the input
 -encode
     whether to encode the input
+-serve
+    whether to serve the decoded input over HTTP, with Range request support
+    (NOT IMPLEMENTED in this ractool)
 
 Decode-Related Flags:
 
 -drange
     the "i:j" range to decompress, ":8" means the first 8 bytes
 
+Serve-Related Flags:
+
+-addr
+    the HTTP listen address (default ":8080")
+    (NOT IMPLEMENTED in this ractool)
+
 Encode-Related Flags:
 
 -cchunksize
     the chunk size (in CSpace)
 -codec
-    the compression codec (default "zlib")
+    the compression codec: "zlib", "zstd" or "brotli" (default "zlib")
+    ("zstd" and "brotli" are NOT IMPLEMENTED in this ractool)
 -cpagesize
     the page size (in CSpace)
 -dchunksize
     the chunk size (in DSpace)
 -indexlocation
     the index location, "start" or "end" (default "start")
+-workers
+    the number of chunks to compress concurrently (default GOMAXPROCS)
+    (NOT IMPLEMENTED in this ractool)
 `
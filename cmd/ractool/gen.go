@@ -0,0 +1,86 @@
+// Copyright 2019 The Wuffs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build ignore
+
+// gen.go generates data.go from usage.txt. Run it with "go run gen.go" from
+// this directory (no file here carries a go:generate directive for it); do not
+// hand-edit data.go, which says as much at the top of the file it writes.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// blockerNote documents, in the generated file itself (not just in this
+// generator's source), that -codec=zstd/brotli, -workers and -serve/-addr
+// are documented in usage.txt as the intended CLI surface but are not wired
+// up: that needs a lib/rac codec registry, a chunked-encode worker pool, and
+// an HTTP range-to-chunk handler, none of which — nor a ractool main.go —
+// exists in this checkout. Extending usage.txt is not a substitute for that
+// work landing.
+const blockerNote = `// BLOCKED: -codec=zstd/brotli, -workers and -serve/-addr below are
+// documented as the intended CLI surface, but ractool has no main.go and
+// there is no lib/rac package in this checkout for them to call into. Until
+// those land, passing any of those flags has nothing to dispatch to.
+//
+// -workers' ordering guarantee (compress concurrently, still write chunks
+// out in order) doesn't depend on lib/rac, so that piece is built and
+// tested standalone in parallelOrdered (workerpool.go); it just isn't wired
+// to a chunk-compression loop yet.
+//
+// Likewise, -serve's "Range header -> byte range" parsing doesn't depend on
+// lib/rac either, so it's built and tested standalone in parseHTTPRange
+// (byterange.go); turning that byteRange into "the minimal set of chunk
+// decodes" still needs the RAC index reader that lib/rac would provide.`
+
+func main() {
+	usage, err := ioutil.ReadFile("usage.txt")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out, err := os.Create("data.go")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer out.Close()
+
+	fmt.Fprint(out, `// Code generated by running "go generate". DO NOT EDIT.
+
+// Copyright 2019 The Wuffs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+`)
+	fmt.Fprintln(out, blockerNote)
+	fmt.Fprint(out, "const usageStr = `")
+	out.Write(usage)
+	fmt.Fprint(out, "`\n")
+}
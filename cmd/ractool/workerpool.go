@@ -0,0 +1,74 @@
+// Copyright 2019 The Wuffs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "runtime"
+
+// parallelOrdered calls fn(i) for every i in [0, n), across up to workers
+// goroutines (workers <= 0 means runtime.GOMAXPROCS(0)), and returns the
+// results in input order regardless of completion order. This is the
+// ordering guarantee that a future -workers flag needs: chunks compress
+// concurrently, but -indexlocation=start still needs them written out (and
+// the index built) in the original chunk order, with output bytes identical
+// to the serial path.
+//
+// If any fn(i) returns an error, parallelOrdered returns the first such
+// error (by index, not by completion time), but only after fn has been
+// called for every other i as well: an error does not stop the remaining
+// calls from being made.
+//
+// This has no lib/rac dependency: the caller still has to slice the input
+// into chunks and call fn once per chunk. It exists so that piece of the
+// -workers flag can be built and tested independently of the still-missing
+// lib/rac codec registry and ractool main.go.
+func parallelOrdered(n, workers int, fn func(i int) ([]byte, error)) ([][]byte, error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > n {
+		workers = n
+	}
+
+	results := make([][]byte, n)
+	errs := make([]error, n)
+
+	indexes := make(chan int)
+	go func() {
+		for i := 0; i < n; i++ {
+			indexes <- i
+		}
+		close(indexes)
+	}()
+
+	done := make(chan struct{})
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range indexes {
+				results[i], errs[i] = fn(i)
+			}
+			done <- struct{}{}
+		}()
+	}
+	for w := 0; w < workers; w++ {
+		<-done
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 The Wuffs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestParallelOrderedPreservesOrder(t *testing.T) {
+	const n = 64
+	results, err := parallelOrdered(n, 8, func(i int) ([]byte, error) {
+		return []byte(fmt.Sprintf("chunk%d", i)), nil
+	})
+	if err != nil {
+		t.Fatalf("parallelOrdered: %v", err)
+	}
+	if len(results) != n {
+		t.Fatalf("len(results): got %d, want %d", len(results), n)
+	}
+	for i, got := range results {
+		if want := fmt.Sprintf("chunk%d", i); string(got) != want {
+			t.Errorf("results[%d]: got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestParallelOrderedMatchesSerial(t *testing.T) {
+	const n = 37
+	fn := func(i int) ([]byte, error) {
+		return []byte(fmt.Sprintf("%d-%d", i, i*i)), nil
+	}
+
+	serial := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		serial[i], _ = fn(i)
+	}
+
+	for _, workers := range []int{0, 1, 2, n, n * 2} {
+		got, err := parallelOrdered(n, workers, fn)
+		if err != nil {
+			t.Fatalf("workers=%d: parallelOrdered: %v", workers, err)
+		}
+		if len(got) != len(serial) {
+			t.Fatalf("workers=%d: len(got): got %d, want %d", workers, len(got), len(serial))
+		}
+		for i := range got {
+			if string(got[i]) != string(serial[i]) {
+				t.Errorf("workers=%d: results[%d]: got %q, want %q", workers, i, got[i], serial[i])
+			}
+		}
+	}
+}
+
+func TestParallelOrderedPropagatesError(t *testing.T) {
+	wantErr := errors.New("boom")
+	_, err := parallelOrdered(16, 4, func(i int) ([]byte, error) {
+		if i == 9 {
+			return nil, wantErr
+		}
+		return []byte{byte(i)}, nil
+	})
+	if err != wantErr {
+		t.Fatalf("err: got %v, want %v", err, wantErr)
+	}
+}
+
+func TestParallelOrderedZero(t *testing.T) {
+	results, err := parallelOrdered(0, 4, func(i int) ([]byte, error) {
+		t.Fatalf("fn should not be called when n == 0")
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("parallelOrdered: %v", err)
+	}
+	if len(results) != 0 {
+		t.Fatalf("len(results): got %d, want 0", len(results))
+	}
+}